@@ -0,0 +1,201 @@
+// Copyright (C) 2019 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// holePunchWindow is how long we keep redialing a peer's candidate
+// addresses before giving up on a punch attempt and staying on the relay.
+const holePunchWindow = 2 * time.Second
+
+// holePunchRedialInterval is how often we retry a candidate address while a
+// punch attempt is in flight.
+const holePunchRedialInterval = 100 * time.Millisecond
+
+// HolePunch is exchanged between two devices, once connected over a relay
+// or plain TCP, to coordinate a simultaneous QUIC dial. It rides along as
+// an extension of the existing hello/cluster-config exchange on that
+// connection; wiring it into the BEP framing is the caller's job, which is
+// why send/recv are passed in as plain functions below rather than this
+// package depending on lib/protocol directly.
+//
+// The exchange is three messages, mirroring libp2p's DCUtR: the initiator
+// sends its candidates (Connect), the responder immediately replies with
+// its own (Connect), and the initiator - now able to measure the round
+// trip - sends a Sync carrying that RTT. The responder dials the instant it
+// receives Sync; the initiator waits RTT/2 after sending it before dialing
+// itself. Call the one-way delays d1 (initiator to responder) and d2
+// (responder to initiator), so rtt = d1+d2: the responder's dial lands at
+// t_send_sync+d1, and the initiator's at t_send_sync+rtt/2 = t_send_sync+
+// (d1+d2)/2. When the path is close to symmetric (d1≈d2, the common case)
+// those two instants coincide, without either side needing a clock
+// synchronized with the other's.
+type HolePunch struct {
+	// Addrs are STUN-learned external host:port candidates for the sender's
+	// QUIC listener. Set on the two Connect messages, empty on Sync.
+	Addrs []string
+	// Nonce correlates an initiator's messages with the responder's reply.
+	Nonce uint64
+	// RTT is the initiator's measured round trip for the Connect/Connect
+	// exchange. Only set on Sync.
+	RTT time.Duration
+}
+
+// holePunchDialer is the subset of quicTransport that punch needs to race
+// candidate dials. It exists so the RTT timing and winner-selection logic
+// below can be exercised against a fake in tests, the way quicTlsConn is
+// tested against a fake quic.Session, without opening a real socket.
+type holePunchDialer interface {
+	DialSession(ctx context.Context, raddr net.Addr, host string, tlsCfg *tls.Config) (quic.Session, error)
+}
+
+// A holePunchCoordinator drives a HolePunch exchange and, once both sides
+// have agreed on a fire time, races a simultaneous QUIC dial against the
+// peer's candidate addresses over the shared transport.
+//
+// Nothing constructs a holePunchCoordinator outside of this package's own
+// tests yet. Firing one requires a connection already established over a
+// relay or plain TCP to ride the HolePunch exchange on, and a place to hand
+// off the winning quic.Session to the priority-upgrade path that replaces
+// that connection - both of which live in the connection service, which
+// this trimmed checkout doesn't include. Wiring that call site, and adding
+// the HolePunch extension to protocol.Hello/ClusterConfig it rides on, is
+// the remaining work before this is reachable outside a test.
+type holePunchCoordinator struct {
+	transport holePunchDialer
+	tlsCfg    *tls.Config
+}
+
+func newHolePunchCoordinator(transport holePunchDialer, tlsCfg *tls.Config) *holePunchCoordinator {
+	return &holePunchCoordinator{transport: transport, tlsCfg: tlsCfg}
+}
+
+// Initiate sends our candidate addresses to the peer, waits for its Connect
+// reply, measures the round trip, and sends that RTT to the peer via Sync -
+// which it should act on immediately - before waiting out the other half of
+// the RTT itself so the two dials land together.
+func (h *holePunchCoordinator) Initiate(ctx context.Context, localAddrs []string, send func(HolePunch) error, recv func(context.Context) (HolePunch, error)) (quic.Session, error) {
+	nonce := newHolePunchNonce()
+	sent := time.Now()
+	if err := send(HolePunch{Addrs: localAddrs, Nonce: nonce}); err != nil {
+		return nil, err
+	}
+
+	reply, err := recv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rtt := time.Since(sent)
+
+	if err := send(HolePunch{Nonce: nonce, RTT: rtt}); err != nil {
+		return nil, err
+	}
+
+	return h.punch(ctx, reply.Addrs, rtt/2)
+}
+
+// Respond waits for the peer's Connect offer, answers with our own
+// candidates, then dials the instant its Sync arrives - the initiator has
+// already started waiting out its own half of the RTT, so both dials land
+// together.
+func (h *holePunchCoordinator) Respond(ctx context.Context, localAddrs []string, recv func(context.Context) (HolePunch, error), send func(HolePunch) error) (quic.Session, error) {
+	offer, err := recv(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := send(HolePunch{Addrs: localAddrs, Nonce: offer.Nonce}); err != nil {
+		return nil, err
+	}
+
+	if _, err := recv(ctx); err != nil {
+		return nil, err
+	}
+
+	return h.punch(ctx, offer.Addrs, 0)
+}
+
+// punch waits delay from now - the point at which both ends of a
+// synchronized exchange should fire together - then redials every
+// candidate address for holePunchWindow and returns the first session that
+// completes a handshake.
+func (h *holePunchCoordinator) punch(ctx context.Context, addrs []string, delay time.Duration) (quic.Session, error) {
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	punchCtx, cancel := context.WithTimeout(ctx, holePunchWindow)
+	defer cancel()
+
+	// sessions is sized for exactly the one winning session: won gates who
+	// is allowed to send on it, so there's never a second sender racing the
+	// buffer once the first has claimed it.
+	sessions := make(chan quic.Session, 1)
+	var won int32
+	for _, addr := range addrs {
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			l.Debugf("hole punch: resolving candidate %s: %s", addr, err)
+			continue
+		}
+		go h.redial(punchCtx, raddr, addr, sessions, &won)
+	}
+
+	select {
+	case session := <-sessions:
+		return session, nil
+	case <-punchCtx.Done():
+		return nil, punchCtx.Err()
+	}
+}
+
+// newHolePunchNonce returns a random value an initiator uses to correlate
+// its offer with the responder's reply.
+func newHolePunchNonce() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// redial races raddr against the other candidates, claiming won via an
+// atomic CAS the instant its dial succeeds. Exactly one redial goroutine
+// ever wins that CAS and sends on sessions; every later winner just closes
+// its session instead, since punch only reads from sessions once.
+func (h *holePunchCoordinator) redial(ctx context.Context, raddr *net.UDPAddr, host string, sessions chan<- quic.Session, won *int32) {
+	for ctx.Err() == nil {
+		session, err := h.transport.DialSession(ctx, raddr, host, h.tlsCfg)
+		if err == nil {
+			if atomic.CompareAndSwapInt32(won, 0, 1) {
+				sessions <- session
+			} else {
+				// Another candidate already won the race.
+				session.Close()
+			}
+			return
+		}
+
+		select {
+		case <-time.After(holePunchRedialInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2019 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// holePunchLink delivers HolePunch messages from one side of a fake
+// connection to the other, each after a fixed one-way delay, so tests can
+// drive Initiate and Respond against a reproducible simulated network
+// instead of duplicating their arithmetic.
+type holePunchLink struct {
+	delay time.Duration
+	ch    chan HolePunch
+}
+
+func newHolePunchLink(delay time.Duration) *holePunchLink {
+	return &holePunchLink{delay: delay, ch: make(chan HolePunch, 4)}
+}
+
+func (l *holePunchLink) send(msg HolePunch) error {
+	time.AfterFunc(l.delay, func() { l.ch <- msg })
+	return nil
+}
+
+func (l *holePunchLink) recv(ctx context.Context) (HolePunch, error) {
+	select {
+	case msg := <-l.ch:
+		return msg, nil
+	case <-ctx.Done():
+		return HolePunch{}, ctx.Err()
+	}
+}
+
+// fakeHolePunchDialer stands in for quicTransport: instead of opening a
+// real socket, it records when each candidate address was "dialed" and
+// hands back a distinct fake session for every call.
+type fakeHolePunchDialer struct {
+	mut      sync.Mutex
+	dialedAt map[string]time.Time
+}
+
+func newFakeHolePunchDialer() *fakeHolePunchDialer {
+	return &fakeHolePunchDialer{dialedAt: make(map[string]time.Time)}
+}
+
+func (d *fakeHolePunchDialer) DialSession(_ context.Context, _ net.Addr, host string, _ *tls.Config) (quic.Session, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.dialedAt[host] = time.Now()
+	return &fakeDatagramSession{}, nil
+}
+
+func (d *fakeHolePunchDialer) firstDial() time.Time {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	var first time.Time
+	for _, at := range d.dialedAt {
+		if first.IsZero() || at.Before(first) {
+			first = at
+		}
+	}
+	return first
+}
+
+// TestHolePunchSynchronizedFireTime drives real Initiate/Respond calls over
+// a simulated link with asymmetric one-way delays and checks that the two
+// sides' dials land together, as HolePunch's doc comment claims. A bug like
+// waiting out rtt instead of rtt/2, or measuring the RTT from the wrong
+// message, would show up here as the two dials landing a full RTT apart
+// instead of within a small tolerance of each other.
+func TestHolePunchSynchronizedFireTime(t *testing.T) {
+	cases := []struct {
+		name   string
+		d1, d2 time.Duration
+	}{
+		{"symmetric", 20 * time.Millisecond, 20 * time.Millisecond},
+		{"initiator closer to responder", 5 * time.Millisecond, 40 * time.Millisecond},
+		{"responder closer to initiator", 40 * time.Millisecond, 5 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			toResponder := newHolePunchLink(c.d1)
+			toInitiator := newHolePunchLink(c.d2)
+
+			initiatorDialer := newFakeHolePunchDialer()
+			responderDialer := newFakeHolePunchDialer()
+			initiator := newHolePunchCoordinator(initiatorDialer, nil)
+			responder := newHolePunchCoordinator(responderDialer, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			// Candidates must be literal IP:port pairs, not hostnames: punch
+			// resolves them with net.ResolveUDPAddr, which would otherwise
+			// try a real DNS lookup.
+			go func() {
+				defer wg.Done()
+				if _, err := initiator.Initiate(ctx, []string{"127.0.0.1:4001"}, toResponder.send, toInitiator.recv); err != nil {
+					t.Errorf("Initiate: %v", err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				if _, err := responder.Respond(ctx, []string{"127.0.0.2:4002"}, toResponder.recv, toInitiator.send); err != nil {
+					t.Errorf("Respond: %v", err)
+				}
+			}()
+			wg.Wait()
+
+			initiatorFire := initiatorDialer.firstDial()
+			responderFire := responderDialer.firstDial()
+			if initiatorFire.IsZero() || responderFire.IsZero() {
+				t.Fatalf("both sides should have dialed; initiator=%v responder=%v", initiatorFire, responderFire)
+			}
+
+			gotDiff := responderFire.Sub(initiatorFire)
+			wantDiff := (c.d1 - c.d2) / 2
+			// Generous tolerance: real goroutine scheduling jitter, not the
+			// thing under test.
+			const tolerance = 15 * time.Millisecond
+			if diff := gotDiff - wantDiff; diff < -tolerance || diff > tolerance {
+				t.Errorf("fire time difference = %v, want %v +/- %v (d1=%v, d2=%v)", gotDiff, wantDiff, tolerance, c.d1, c.d2)
+			}
+		})
+	}
+}
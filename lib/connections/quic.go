@@ -0,0 +1,17 @@
+// Copyright (C) 2019 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import "github.com/lucas-clemente/quic-go"
+
+// quicConfig is shared by every QUIC listener, dialer and hole-punch
+// attempt in this package. EnableDatagrams lets connections carry
+// best-effort, unreliable DATAGRAM frames alongside the regular stream,
+// see quicTlsConn.SendMessage/ReceiveMessage.
+var quicConfig = &quic.Config{
+	EnableDatagrams: true,
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2019 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import (
+	"crypto/tls"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// quicTlsConn adapts a QUIC session and its one BEP stream to net.Conn.
+// Reads and writes go via the embedded Stream; the embedded Session
+// supplies addressing and, now that quicConfig enables datagrams, an
+// unreliable side channel alongside that stream.
+type quicTlsConn struct {
+	quic.Session
+	quic.Stream
+}
+
+func (q *quicTlsConn) Close() error {
+	defer q.Session.Close()
+	return q.Stream.Close()
+}
+
+// ConnectionState returns the local handshake state for reporting on the
+// connection in the UI.
+func (q *quicTlsConn) ConnectionState() tls.ConnectionState {
+	return q.Session.ConnectionState().TLS.ConnectionState
+}
+
+// SendMessage sends msg as a single, unreliable QUIC DATAGRAM frame. It is
+// best-effort: the frame may be dropped, reordered, or arrive ahead of data
+// already written to the stream. Callers that need delivery guarantees
+// should use the stream (Write) instead.
+func (q *quicTlsConn) SendMessage(msg []byte) error {
+	return q.Session.SendMessage(msg)
+}
+
+// ReceiveMessage blocks until a DATAGRAM frame arrives on the session, or
+// the session is closed.
+func (q *quicTlsConn) ReceiveMessage() ([]byte, error) {
+	return q.Session.ReceiveMessage()
+}
+
+// datagramConn is implemented by internalConn.Conn when the underlying
+// transport supports unreliable, best-effort delivery alongside the
+// regular BEP stream - currently only quicTlsConn. Nothing in this package
+// consumes it yet: plumbing an optional datagram side channel through
+// protocol.Connection, with capability negotiation in the hello exchange
+// and a fallback to the stream for peers that don't advertise it, is a
+// separate piece of work against lib/protocol. This interface exists so
+// that work can type-assert a connection's Conn against it without caring
+// which transport produced it.
+type datagramConn interface {
+	SendMessage([]byte) error
+	ReceiveMessage() ([]byte, error)
+}
+
+var _ datagramConn = (*quicTlsConn)(nil)
@@ -0,0 +1,74 @@
+// Copyright (C) 2019 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// fakeDatagramSession is a quic.Session that only implements SendMessage
+// and ReceiveMessage; every other method is promoted from the nil embedded
+// quic.Session and must not be called by the tests below.
+type fakeDatagramSession struct {
+	quic.Session
+
+	sent     [][]byte
+	received [][]byte
+	recvErr  error
+}
+
+func (f *fakeDatagramSession) SendMessage(msg []byte) error {
+	f.sent = append(f.sent, msg)
+	return nil
+}
+
+func (f *fakeDatagramSession) ReceiveMessage() ([]byte, error) {
+	if len(f.received) == 0 {
+		return nil, f.recvErr
+	}
+	msg := f.received[0]
+	f.received = f.received[1:]
+	return msg, nil
+}
+
+func TestQuicTlsConnSendMessage(t *testing.T) {
+	session := &fakeDatagramSession{}
+	conn := &quicTlsConn{Session: session}
+
+	if err := conn.SendMessage([]byte("hello")); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if len(session.sent) != 1 || string(session.sent[0]) != "hello" {
+		t.Errorf("got %v, want a single \"hello\" datagram sent to the session", session.sent)
+	}
+}
+
+func TestQuicTlsConnReceiveMessage(t *testing.T) {
+	session := &fakeDatagramSession{received: [][]byte{[]byte("world")}}
+	conn := &quicTlsConn{Session: session}
+
+	msg, err := conn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("ReceiveMessage: %v", err)
+	}
+	if string(msg) != "world" {
+		t.Errorf("got %q, want %q", msg, "world")
+	}
+}
+
+func TestQuicTlsConnReceiveMessageError(t *testing.T) {
+	wantErr := errors.New("session closed")
+	session := &fakeDatagramSession{recvErr: wantErr}
+	conn := &quicTlsConn{Session: session}
+
+	if _, err := conn.ReceiveMessage(); err != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+}
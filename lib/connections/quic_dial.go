@@ -0,0 +1,116 @@
+// Copyright (C) 2019 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/lucas-clemente/quic-go"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+func init() {
+	for _, scheme := range []string{"quic", "quic4", "quic6"} {
+		dialers[scheme] = &quicDialerFactory{}
+	}
+}
+
+type quicDialer struct {
+	cfg    config.Wrapper
+	tlsCfg *tls.Config
+}
+
+// Dial opens a QUIC session to uri. When a quicListener is already serving
+// the same scheme, the shared transport is reused so the dial goes out from
+// the same socket, and hence the same external NAT mapping, that STUN
+// discovered for our listener. Otherwise we fall back to dialing from a
+// fresh ephemeral socket as before.
+func (d *quicDialer) Dial(_ protocol.DeviceID, uri *url.URL) (internalConn, error) {
+	uri = fixupPort(uri, config.DefaultQUICPort)
+
+	addr, err := net.ResolveUDPAddr(strings.Replace(uri.Scheme, "quic", "udp", -1), uri.Host)
+	if err != nil {
+		return internalConn{}, err
+	}
+
+	if transport, ok := getQUICTransport(uri.Scheme); ok {
+		session, err := transport.DialSession(context.Background(), addr, uri.String(), d.tlsCfg)
+		if err != nil {
+			return internalConn{}, err
+		}
+		return quicDialerWrap(session)
+	}
+
+	packetConn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return internalConn{}, err
+	}
+
+	session, err := quic.DialContext(context.Background(), packetConn, addr, uri.String(), d.tlsCfg, quicConfig)
+	if err != nil {
+		packetConn.Close()
+		return internalConn{}, err
+	}
+
+	return quicDialerWrap(&packetConnClosingSession{Session: session, packetConn: packetConn})
+}
+
+// packetConnClosingSession wraps a quic.Session dialed from a private,
+// ephemeral packetConn (the no-shared-transport fallback above) so that
+// closing the session also closes the socket it owns. Without this, every
+// such dial leaks a UDP socket for the life of the process rather than the
+// life of the session.
+type packetConnClosingSession struct {
+	quic.Session
+	packetConn net.PacketConn
+}
+
+func (s *packetConnClosingSession) Close() error {
+	defer s.packetConn.Close()
+	return s.Session.Close()
+}
+
+func quicDialerWrap(session quic.Session) (internalConn, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return internalConn{}, err
+	}
+
+	return internalConn{&quicTlsConn{session, stream}, connTypeQUICClient, quicPriority}, nil
+}
+
+type quicDialerFactory struct{}
+
+func (quicDialerFactory) New(cfg config.Wrapper, tlsCfg *tls.Config) genericDialer {
+	return &quicDialer{
+		cfg:    cfg,
+		tlsCfg: tlsCfg,
+	}
+}
+
+func (quicDialerFactory) Priority() int {
+	return quicPriority
+}
+
+func (quicDialerFactory) AlwaysWAN() bool {
+	return false
+}
+
+func (quicDialerFactory) Valid(_ config.Configuration) error {
+	return nil
+}
+
+func (quicDialerFactory) String() string {
+	return "QUIC Dialer"
+}
@@ -8,24 +8,36 @@ package connections
 
 import (
 	"crypto/tls"
+	"errors"
 	"net"
 	"net/url"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/AudriusButkevicius/pfilter"
 	"github.com/ccding/go-stun/stun"
-	"github.com/lucas-clemente/quic-go"
 
 	"github.com/syncthing/syncthing/lib/config"
-	"github.com/syncthing/syncthing/lib/connections/registry"
 	"github.com/syncthing/syncthing/lib/nat"
 )
 
 const stunRetryInterval = 5 * time.Minute
 
+// stunDiscoverWorkers bounds how many STUN servers we contact concurrently
+// during a discovery round.
+const stunDiscoverWorkers = 4
+
+// stunRoundTripTimeout bounds how long a single STUN round trip may hold
+// stunMu. It's enforced as a read deadline on the shared socket itself,
+// not just a goroutine-local timer, so a server that never answers can't
+// leave a read in flight past this window to steal a later caller's
+// response once the lock is released - it actually aborts at the socket.
+const stunRoundTripTimeout = 5 * time.Second
+
+// errNATNotUsable marks a discovery result whose server responded but
+// reported a NAT type we can't do anything useful with.
+var errNATNotUsable = errors.New("stun: nat type not usable")
+
 func init() {
 	factory := &quicListenerFactory{}
 	for _, scheme := range []string{"quic", "quic4", "quic6"} {
@@ -44,9 +56,57 @@ type quicListener struct {
 	factory listenerFactory
 	nat     atomic.Value
 
-	address *url.URL
-	err     error
-	mut     sync.RWMutex
+	address    *url.URL
+	err        error
+	stunHealth map[string]*stunServerHealth
+	mut        sync.RWMutex
+
+	// stunMu serializes the actual STUN round trips made on the shared
+	// listener socket. Discovery and keepalive goroutines run concurrently
+	// per server, but net/go-stun has no transaction-level demuxing of its
+	// own, so two requests in flight at once on the same socket can have
+	// their responses stolen by each other's Read. The listener socket
+	// can't simply be swapped for a private one per goroutine either: its
+	// whole purpose is that the external mapping STUN discovers is the one
+	// our QUIC listener's socket actually has (see quicTransport), so
+	// serializing is the fix rather than separating the sockets. Each round
+	// trip taken under this lock also has its own stunRoundTripTimeout read
+	// deadline set on the socket, so a single dead or unresponsive server
+	// can only stall the others queued behind the lock for that bounded
+	// window, rather than for however long go-stun's blocking call would
+	// otherwise sit waiting on it - which is what made the worker pool in
+	// discoverAll no faster than the old sequential loop against a dead
+	// server.
+	stunMu sync.Mutex
+}
+
+// stunServerHealth tracks the recent behaviour of a single configured STUN
+// server, so a slow or flapping server can be deprioritized without losing
+// track of the mapping a healthier one is maintaining for us.
+type stunServerHealth struct {
+	rtt              time.Duration
+	consecutiveFails int
+	mapping          string
+}
+
+// StunServerHealth is the externally-facing view of stunServerHealth for a
+// single server address, shaped for a REST endpoint to serialize as-is.
+// Nothing in this trimmed checkout actually exposes it over REST yet -
+// there's no REST package here to wire it into - so for now NATStatus is
+// reachable only by calling quicListener.NATStatus() directly.
+type StunServerHealth struct {
+	RTTMillis        int64  `json:"rttMs"`
+	ConsecutiveFails int    `json:"consecutiveFails"`
+	Mapping          string `json:"mapping"`
+}
+
+// NATStatus is the externally-facing summary of what our most recent STUN
+// round learned, returned by quicListener.NATStatus(). See
+// StunServerHealth's doc comment for why "externally-facing" rather than
+// "REST-facing" here: that wiring doesn't exist in this checkout.
+type NATStatus struct {
+	Type    string                      `json:"type"`
+	Servers map[string]StunServerHealth `json:"servers"`
 }
 
 func (t *quicListener) Serve() {
@@ -54,9 +114,7 @@ func (t *quicListener) Serve() {
 	t.err = nil
 	t.mut.Unlock()
 
-	network := strings.Replace(t.uri.Scheme, "quic", "udp", -1)
-
-	packetConn, err := net.ListenPacket(network, t.uri.Host)
+	transport, err := newQUICTransport(t.uri, t.tlsCfg)
 	if err != nil {
 		t.mut.Lock()
 		t.err = err
@@ -64,47 +122,27 @@ func (t *quicListener) Serve() {
 		l.Infoln("Listen (BEP/quic):", err)
 		return
 	}
-	filterConn := pfilter.NewPacketFilter(packetConn)
-	quicConn := filterConn.NewConn(quicFilterPriority, nil)
-	stunConn := filterConn.NewConn(stunFilterPriority, &stunFilter{
-		ids: make(map[string]time.Time),
-	})
-
-	filterConn.Start()
-	registry.Register(t.uri.Scheme, quicConn)
 
-	listener, err := quic.Listen(quicConn, t.tlsCfg, quicConfig)
-	if err != nil {
-		t.mut.Lock()
-		t.err = err
-		t.mut.Unlock()
-		l.Infoln("Listen (BEP/quic):", err)
-		return
-	}
+	registerQUICTransport(t.uri.Scheme, transport)
+	defer unregisterQUICTransport(t.uri.Scheme)
+	defer transport.Close()
 
-	defer listener.Close()
-	defer stunConn.Close()
-	defer quicConn.Close()
-	defer registry.Unregister(t.uri.Scheme, quicConn)
-	defer filterConn.Close()
-	defer packetConn.Close()
+	l.Infof("QUIC listener (%v) starting", transport.LocalAddr())
+	defer l.Infof("QUIC listener (%v) shutting down", transport.LocalAddr())
 
-	l.Infof("QUIC listener (%v) starting", quicConn.LocalAddr())
-	defer l.Infof("QUIC listener (%v) shutting down", quicConn.LocalAddr())
-
-	go t.stunRenewal(stunConn)
+	go t.stunRenewal(transport.STUNConn())
 
 	// Accept is forever, so handle stops externally.
 	go func() {
 		select {
 		case <-t.stop:
-			_ = listener.Close()
+			_ = transport.Close()
 		}
 	}()
 
 	for {
 		// Blocks forever, see https://github.com/lucas-clemente/quic-go/issues/1915
-		session, err := listener.Accept()
+		session, err := transport.AcceptSession()
 
 		select {
 		case <-t.stop:
@@ -192,20 +230,29 @@ func (t *quicListener) NATType() string {
 	return v.String()
 }
 
-func (t *quicListener) stunRenewal(listener net.PacketConn) {
-	client := stun.NewClientWithConnection(listener)
-	client.SetSoftwareName("")
+// stunHost is the subset of *stun.Host that pickMajority and recordHealth
+// rely on. stun.Host has no exported constructor, so keying discovery
+// results off this small interface instead of the concrete type lets
+// pickMajority's grouping logic be unit tested without a real STUN
+// exchange; *stun.Host satisfies it as-is.
+type stunHost interface {
+	TransportAddr() string
+}
 
-	var natType stun.NATType
-	var extAddr *stun.Host
-	var udpAddr *net.UDPAddr
-	var err error
+// stunDiscoverResult is what one goroutine in the discovery worker pool
+// reports back for a single configured STUN server.
+type stunDiscoverResult struct {
+	addr    string
+	natType stun.NATType
+	extAddr stunHost
+	rtt     time.Duration
+	err     error
+}
 
+func (t *quicListener) stunRenewal(listener net.PacketConn) {
 	oldType := stun.NATUnknown
 
 	for {
-
-	disabled:
 		if t.cfg.Options().StunKeepaliveS < 1 || !t.cfg.Options().NATEnabled {
 			time.Sleep(time.Second)
 			oldType = stun.NATUnknown
@@ -216,94 +263,417 @@ func (t *quicListener) stunRenewal(listener net.PacketConn) {
 			continue
 		}
 
-		for _, addr := range t.cfg.StunServers() {
-			// Resolve the address, so that in case the server advertises two
-			// IPs, we always hit the same one, as otherwise, the mapping might
-			// expire as we hit the other address, and cause us to flip flop
-			// between servers/external addresses, as a result flooding discovery
-			// servers.
-			udpAddr, err = net.ResolveUDPAddr("udp", addr)
-			if err != nil {
-				l.Debugf("%s stun addr resolution on %s: %s", t.uri, addr, err)
-				continue
+		results := t.discoverAll(listener, t.cfg.StunServers())
+
+		best, ok := pickMajority(results)
+		if !ok {
+			// None of the configured servers answered with a punchable NAT
+			// type. Chillout for a while before trying them all again.
+			time.Sleep(stunRetryInterval)
+			continue
+		}
+
+		if oldType != best.natType {
+			l.Infof("%s detected NAT type: %s", t.uri, best.natType)
+			t.nat.Store(best.natType)
+			oldType = best.natType
+		}
+
+		// Keep the mapping alive on every server that gave us a punchable
+		// result, in parallel, so a single dying STUN server doesn't cost
+		// us our external mapping. Only best's server is allowed to publish
+		// t.address though - otherwise two healthy but disagreeing servers
+		// would fight over it on every tick. This call blocks until all of
+		// them have given up, at which point we go back around and
+		// rediscover.
+		stopped, disabled := t.keepaliveAll(listener, results, best.addr)
+		if stopped {
+			return
+		}
+		if disabled {
+			// NAT/STUN got disabled while a keepalive was in flight; loop
+			// straight back to the disabled check above instead of sitting
+			// on a stale mapping for stunRetryInterval.
+			continue
+		}
+
+		time.Sleep(stunRetryInterval)
+	}
+}
+
+// discoverAll fans Discover() for every configured server out to a bounded
+// worker pool and returns one result per server, in no particular order.
+func (t *quicListener) discoverAll(listener net.PacketConn, servers []string) []stunDiscoverResult {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	workers := stunDiscoverWorkers
+	if workers > len(servers) {
+		workers = len(servers)
+	}
+
+	jobs := make(chan string)
+	results := make(chan stunDiscoverResult, len(servers))
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for addr := range jobs {
+				results <- t.discoverOne(listener, addr)
 			}
-			client.SetServerAddr(udpAddr.String())
+		}()
+	}
+
+	go func() {
+		for _, addr := range servers {
+			jobs <- addr
+		}
+		close(jobs)
+	}()
 
-			natType, extAddr, err = client.Discover()
-			if err != nil || extAddr == nil {
-				l.Debugf("%s stun discovery on %s: %s", t.uri, addr, err)
-				continue
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	out := make([]stunDiscoverResult, 0, len(servers))
+	for res := range results {
+		t.recordHealth(res)
+		out = append(out, res)
+	}
+	return out
+}
+
+// discoverOne resolves addr and runs a single STUN discovery against it,
+// timing how long the round trip took.
+func (t *quicListener) discoverOne(listener net.PacketConn, addr string) stunDiscoverResult {
+	// Resolve the address, so that in case the server advertises two IPs, we
+	// always hit the same one, as otherwise the mapping might expire as we
+	// hit the other address, and cause us to flip flop between servers and
+	// external addresses, flooding discovery servers as a result.
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		l.Debugf("%s stun addr resolution on %s: %s", t.uri, addr, err)
+		return stunDiscoverResult{addr: addr, err: err}
+	}
+
+	client := stun.NewClientWithConnection(listener)
+	client.SetSoftwareName("")
+	client.SetServerAddr(udpAddr.String())
+
+	t.stunMu.Lock()
+	_ = listener.SetReadDeadline(time.Now().Add(stunRoundTripTimeout))
+	start := time.Now()
+	natType, extAddr, err := client.Discover()
+	rtt := time.Since(start)
+	_ = listener.SetReadDeadline(time.Time{})
+	t.stunMu.Unlock()
+	if err != nil || extAddr == nil {
+		l.Debugf("%s stun discovery on %s: %s", t.uri, addr, err)
+		return stunDiscoverResult{addr: addr, rtt: rtt, err: err}
+	}
+
+	// The stun server is most likely borked, try another one.
+	if natType == stun.NATError || natType == stun.NATUnknown || natType == stun.NATBlocked {
+		l.Debugf("%s stun discovery on %s resolved to %s", t.uri, addr, natType)
+		return stunDiscoverResult{addr: addr, natType: natType, rtt: rtt, err: errNATNotUsable}
+	}
+
+	return stunDiscoverResult{addr: addr, natType: natType, extAddr: extAddr, rtt: rtt}
+}
+
+// pickMajority picks the external address that the most servers agree on
+// among punchable results. Within a group of servers that agree, and when
+// breaking a tie between two equally-agreed-on addresses, the server with
+// the lower measured RTT is preferred - it's the one that becomes
+// keepaliveAll's initial active server, so a faster responder there means
+// fewer keepalive round trips are spent on a server that's more likely to
+// be slow or flaky. A further RTT tie falls back to the lowest address,
+// for determinism.
+func pickMajority(results []stunDiscoverResult) (stunDiscoverResult, bool) {
+	counts := make(map[string]int)
+	fastest := make(map[string]stunDiscoverResult)
+	for _, res := range results {
+		if res.err != nil || res.extAddr == nil || !isPunchable(res.natType) {
+			continue
+		}
+		key := res.extAddr.TransportAddr()
+		counts[key]++
+		if cur, ok := fastest[key]; !ok || res.rtt < cur.rtt {
+			fastest[key] = res
+		}
+	}
+
+	var bestKey string
+	bestCount := 0
+	for key, count := range counts {
+		if count > bestCount {
+			bestKey, bestCount = key, count
+			continue
+		}
+		if count == bestCount && bestCount > 0 {
+			cur, challenger := fastest[bestKey], fastest[key]
+			if challenger.rtt < cur.rtt || (challenger.rtt == cur.rtt && key < bestKey) {
+				bestKey = key
 			}
+		}
+	}
+	if bestCount == 0 {
+		return stunDiscoverResult{}, false
+	}
+	return fastest[bestKey], true
+}
+
+// recordHealth updates the per-server health snapshot exposed via
+// NATStatus() with the outcome of a discovery or keepalive round.
+func (t *quicListener) recordHealth(res stunDiscoverResult) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if t.stunHealth == nil {
+		t.stunHealth = make(map[string]*stunServerHealth)
+	}
+	health, ok := t.stunHealth[res.addr]
+	if !ok {
+		health = &stunServerHealth{}
+		t.stunHealth[res.addr] = health
+	}
+
+	if res.err != nil {
+		health.consecutiveFails++
+		return
+	}
+	health.consecutiveFails = 0
+	health.rtt = res.rtt
+	if res.extAddr != nil {
+		health.mapping = res.extAddr.TransportAddr()
+	}
+}
+
+// keepaliveElection tracks, across the sibling goroutines one keepaliveAll
+// call starts, which server is currently allowed to publish to t.address.
+// It starts out as the server pickMajority chose; if that one's keepalive
+// fails while others are still running, election hands the role to the
+// running survivor with the lowest last-known RTT in its place, instead of
+// leaving t.address pointing at a mapping nobody is renewing until every
+// other server has also given up.
+type keepaliveElection struct {
+	mu      sync.Mutex
+	active  string
+	running map[string]time.Duration // addr -> last known RTT, while still running
+}
+
+func newKeepaliveElection(activeAddr string, results []stunDiscoverResult) *keepaliveElection {
+	running := make(map[string]time.Duration, len(results))
+	for _, res := range results {
+		running[res.addr] = res.rtt
+	}
+	return &keepaliveElection{active: activeAddr, running: running}
+}
+
+// isActive reports whether addr is currently allowed to publish.
+func (e *keepaliveElection) isActive(addr string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.active == addr
+}
+
+// updateRTT records addr's latest measured RTT, so a future promotion
+// favours whichever survivor has actually been responding fastest lately
+// rather than just its RTT from the initial discovery round.
+func (e *keepaliveElection) updateRTT(addr string, rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.running[addr]; ok {
+		e.running[addr] = rtt
+	}
+}
+
+// resign removes addr from the running set. If addr was the active server,
+// the running survivor with the lowest RTT (ties broken by address, for
+// determinism) is promoted in its place; if none are left, nobody is
+// active until the next discovery round.
+func (e *keepaliveElection) resign(addr string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.running, addr)
+	if e.active != addr {
+		return
+	}
+
+	var next string
+	var nextRTT time.Duration
+	for a, rtt := range e.running {
+		if next == "" || rtt < nextRTT || (rtt == nextRTT && a < next) {
+			next, nextRTT = a, rtt
+		}
+	}
+	e.active = next
+}
+
+// keepaliveAll starts an independent keepalive goroutine for every result
+// with a punchable, usable mapping, and waits for all of them to give up.
+// activeAddr is the server pickMajority chose this round; only the current
+// election.active server is allowed to publish t.address at any moment, so
+// that servers which disagree about our external mapping don't fight over
+// it - but unlike a fixed assignment, the active role moves to another
+// still-running server if its current holder's keepalive fails, per
+// keepaliveElection. stopped is true if it returned because the listener
+// was asked to stop; disabled is true if it returned because NAT/STUN got
+// disabled mid-keepalive, in which case the caller should recheck
+// immediately rather than wait out stunRetryInterval.
+func (t *quicListener) keepaliveAll(listener net.PacketConn, results []stunDiscoverResult, activeAddr string) (stopped, disabled bool) {
+	punchable := make([]stunDiscoverResult, 0, len(results))
+	for _, res := range results {
+		if res.err != nil || res.extAddr == nil || !isPunchable(res.natType) {
+			continue
+		}
+		punchable = append(punchable, res)
+	}
 
-			// The stun server is most likely borked, try another one.
-			if natType == stun.NATError || natType == stun.NATUnknown || natType == stun.NATBlocked {
-				l.Debugf("%s stun discovery on %s resolved to %s", t.uri, addr, natType)
-				continue
+	election := newKeepaliveElection(activeAddr, punchable)
+
+	var wg sync.WaitGroup
+	var stoppedFlag, disabledFlag int32
+	for _, res := range punchable {
+		wg.Add(1)
+		go func(res stunDiscoverResult) {
+			defer wg.Done()
+			switch t.keepaliveServer(listener, res.addr, res.extAddr, election) {
+			case keepaliveStopped:
+				atomic.StoreInt32(&stoppedFlag, 1)
+			case keepaliveDisabled:
+				atomic.StoreInt32(&disabledFlag, 1)
 			}
+		}(res)
+	}
+	wg.Wait()
+	return atomic.LoadInt32(&stoppedFlag) != 0, atomic.LoadInt32(&disabledFlag) != 0
+}
+
+// keepaliveOutcome describes why a single server's keepaliveServer loop
+// returned, so keepaliveAll can decide how the caller should proceed.
+type keepaliveOutcome int
+
+const (
+	// keepaliveFailed means the server stopped responding or its mapping
+	// was flapping; an ordinary failure, nothing else to do for this server.
+	keepaliveFailed keepaliveOutcome = iota
+	// keepaliveStopped means the listener was asked to stop.
+	keepaliveStopped
+	// keepaliveDisabled means NAT/STUN got disabled while this keepalive was
+	// in flight.
+	keepaliveDisabled
+)
+
+// keepaliveServer repeatedly renews the mapping res learned on a single
+// server, until the server drops the binding, NAT/STUN gets disabled, or
+// the listener is stopped. Only while election considers addr the active
+// server does it publish its mapping to t.address as it changes; other
+// servers' keepalives still run (so they're ready to take over as the
+// active one, via election.resign, the moment the current holder fails)
+// but only update their own health, since otherwise two servers that
+// disagree about our external mapping would overwrite t.address every
+// tick. election.resign(addr) always runs before this returns, so a
+// promotion happens even when addr is the one failing.
+func (t *quicListener) keepaliveServer(listener net.PacketConn, addr string, extAddr stunHost, election *keepaliveElection) keepaliveOutcome {
+	defer election.resign(addr)
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return keepaliveFailed
+	}
+
+	client := stun.NewClientWithConnection(listener)
+	client.SetSoftwareName("")
+	client.SetServerAddr(udpAddr.String())
+
+	addressChanges := 1
+	activeLoops := 0
+	for {
+		if election.isActive(addr) {
+			activeLoops++
+			changed := false
+
+			uri := *t.uri
+			uri.Host = extAddr.TransportAddr()
 
-			if oldType != natType {
-				l.Infof("%s detected NAT type: %s", t.uri, natType)
-				t.nat.Store(natType)
-				oldType = natType
+			t.mut.Lock()
+			if t.address == nil || t.address.String() != uri.String() {
+				l.Infof("%s resolved external address %s (via %s)", t.uri, uri.String(), addr)
+				t.address = &uri
+				changed = true
+				addressChanges++
 			}
+			t.mut.Unlock()
 
-			// We can't punch through this one, so no point doing keepalives
-			// and such, just try again in a minute and hope that the NAT type changes.
-			if !isPunchable(natType) {
-				break
+			// Check that after a few rounds we're not changing addresses at a stupid rate.
+			// If we're changing addresses on every second request, something is stuffed with the stun server
+			// or router... activeLoops, not the total loop count, is what we check here: a
+			// server promoted to active partway through its run shouldn't inherit the
+			// iteration count it spent sitting idle as a backup before that, or this check
+			// would take far longer than intended to trip on a server that turns out to be
+			// flapping only once it takes over.
+			if activeLoops > 3 && activeLoops/addressChanges < 2 {
+				return keepaliveFailed
 			}
 
-			addressChanges := 1
-			for loops := 1; ; loops++ {
-				changed := false
-
-				uri := *t.uri
-				uri.Host = extAddr.TransportAddr()
-
-				t.mut.Lock()
-
-				if t.address == nil || t.address.String() != uri.String() {
-					l.Infof("%s resolved external address %s (via %s)", t.uri, uri.String(), addr)
-					t.address = &uri
-					changed = true
-					addressChanges++
-				}
-				t.mut.Unlock()
-
-				// Check that after a few rounds we're not changing addresses at a stupid rate.
-				// If we're changing addresses on every second request, something is stuffed with the stun server
-				// or router...
-				if loops > 3 && loops/addressChanges < 2 {
-					break
-				}
-
-				// This will most likely result in a call to WANAddresses() which tries to
-				// get t.mut, so notify while unlocked.
-				if changed {
-					t.notifyAddressesChanged(t)
-				}
-
-				select {
-				case <-time.After(time.Duration(t.cfg.Options().StunKeepaliveS) * time.Second):
-				case <-t.stop:
-					return
-				}
-
-				if t.cfg.Options().StunKeepaliveS < 1 || !t.cfg.Options().NATEnabled {
-					goto disabled
-				}
-
-				extAddr, err = client.Keepalive()
-				if err != nil {
-					l.Debugf("%s stun keepalive on %s: %s (%v)", t.uri, addr, err, extAddr)
-					break
-				}
+			// This will most likely result in a call to WANAddresses() which tries to
+			// get t.mut, so notify while unlocked.
+			if changed {
+				t.notifyAddressesChanged(t)
 			}
 		}
 
-		// We failed to contact all provided stun servers or the nat is not punchable.
-		// Chillout for a while.
-		time.Sleep(stunRetryInterval)
+		select {
+		case <-time.After(time.Duration(t.cfg.Options().StunKeepaliveS) * time.Second):
+		case <-t.stop:
+			return keepaliveStopped
+		}
+
+		if t.cfg.Options().StunKeepaliveS < 1 || !t.cfg.Options().NATEnabled {
+			return keepaliveDisabled
+		}
+
+		t.stunMu.Lock()
+		_ = listener.SetReadDeadline(time.Now().Add(stunRoundTripTimeout))
+		start := time.Now()
+		extAddr, err = client.Keepalive()
+		rtt := time.Since(start)
+		_ = listener.SetReadDeadline(time.Time{})
+		t.stunMu.Unlock()
+		if err != nil {
+			l.Debugf("%s stun keepalive on %s: %s (%v)", t.uri, addr, err, extAddr)
+			t.recordHealth(stunDiscoverResult{addr: addr, rtt: rtt, err: err})
+			return keepaliveFailed
+		}
+		t.recordHealth(stunDiscoverResult{addr: addr, natType: stun.NATUnknown, extAddr: extAddr, rtt: rtt})
+		election.updateRTT(addr, rtt)
+	}
+}
+
+// NATStatus reports the health of every configured STUN server as of the
+// most recent discovery or keepalive round. It's shaped for a REST
+// endpoint to return, but this checkout has no REST package to register
+// one in, so nothing calls this yet.
+func (t *quicListener) NATStatus() NATStatus {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+
+	servers := make(map[string]StunServerHealth, len(t.stunHealth))
+	for addr, health := range t.stunHealth {
+		servers[addr] = StunServerHealth{
+			RTTMillis:        health.rtt.Milliseconds(),
+			ConsecutiveFails: health.consecutiveFails,
+			Mapping:          health.mapping,
+		}
+	}
+	return NATStatus{
+		Type:    t.NATType(),
+		Servers: servers,
 	}
 }
 
@@ -0,0 +1,165 @@
+// Copyright (C) 2019 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// fakeStunHost is a stunHost with a caller-chosen transport address, used so
+// pickMajority can be exercised without a real STUN exchange.
+type fakeStunHost string
+
+func (h fakeStunHost) TransportAddr() string { return string(h) }
+
+func TestPickMajorityNoResults(t *testing.T) {
+	if _, ok := pickMajority(nil); ok {
+		t.Error("expected no result from an empty set")
+	}
+}
+
+func TestPickMajorityIgnoresUnusableResults(t *testing.T) {
+	results := []stunDiscoverResult{
+		{addr: "a", err: errors.New("boom")},
+		{addr: "b", natType: stun.NATBlocked, extAddr: fakeStunHost("1.2.3.4:1111")},
+		{addr: "c", natType: stun.NATUnknown, extAddr: fakeStunHost("5.6.7.8:2222")},
+	}
+	if _, ok := pickMajority(results); ok {
+		t.Error("expected no result when every candidate is unusable")
+	}
+}
+
+func TestPickMajorityPicksMostAgreed(t *testing.T) {
+	const minority = fakeStunHost("1.2.3.4:1111")
+	const majority = fakeStunHost("5.6.7.8:2222")
+
+	results := []stunDiscoverResult{
+		{addr: "a", natType: stun.NATFull, extAddr: minority},
+		{addr: "b", natType: stun.NATFull, extAddr: majority},
+		{addr: "c", natType: stun.NATFull, extAddr: majority},
+	}
+
+	best, ok := pickMajority(results)
+	if !ok {
+		t.Fatal("expected a result")
+	}
+	if best.extAddr.TransportAddr() != string(majority) {
+		t.Errorf("picked %s, want the address two of three servers agreed on", best.extAddr.TransportAddr())
+	}
+}
+
+func TestPickMajorityBreaksTiesByAddress(t *testing.T) {
+	const hostA = fakeStunHost("1.2.3.4:1111")
+	const hostB = fakeStunHost("5.6.7.8:2222")
+
+	// Both addresses are agreed on by exactly one server, so the tie is
+	// broken by the lower of the two transport address strings.
+	results := []stunDiscoverResult{
+		{addr: "a", natType: stun.NATFull, extAddr: hostB},
+		{addr: "b", natType: stun.NATFull, extAddr: hostA},
+	}
+
+	best, ok := pickMajority(results)
+	if !ok {
+		t.Fatal("expected a result")
+	}
+	if best.extAddr.TransportAddr() != string(hostA) {
+		t.Errorf("picked %s, want the lexicographically lowest tied address %s", best.extAddr.TransportAddr(), string(hostA))
+	}
+}
+
+func TestPickMajorityPrefersLowerRTTOnTie(t *testing.T) {
+	const hostA = fakeStunHost("1.2.3.4:1111")
+	const hostB = fakeStunHost("5.6.7.8:2222")
+
+	// Both addresses are agreed on by exactly one server; hostB's server
+	// answered faster, so it should win despite hostA sorting first
+	// lexicographically.
+	results := []stunDiscoverResult{
+		{addr: "a", natType: stun.NATFull, extAddr: hostA, rtt: 50 * time.Millisecond},
+		{addr: "b", natType: stun.NATFull, extAddr: hostB, rtt: 5 * time.Millisecond},
+	}
+
+	best, ok := pickMajority(results)
+	if !ok {
+		t.Fatal("expected a result")
+	}
+	if best.extAddr.TransportAddr() != string(hostB) {
+		t.Errorf("picked %s, want the faster-responding tied address %s", best.extAddr.TransportAddr(), string(hostB))
+	}
+}
+
+func TestKeepaliveElectionPromotesFastestSurvivorOnResign(t *testing.T) {
+	results := []stunDiscoverResult{
+		{addr: "a", rtt: 10 * time.Millisecond},
+		{addr: "b", rtt: 5 * time.Millisecond},
+		{addr: "c", rtt: 20 * time.Millisecond},
+	}
+	election := newKeepaliveElection("a", results)
+
+	if !election.isActive("a") {
+		t.Fatal("expected a to start active")
+	}
+
+	election.resign("a")
+
+	if election.isActive("a") {
+		t.Error("a resigned, should no longer be active")
+	}
+	if !election.isActive("b") {
+		t.Error("expected b, the fastest survivor, to be promoted")
+	}
+}
+
+func TestKeepaliveElectionNonActiveResignDoesNotPromote(t *testing.T) {
+	results := []stunDiscoverResult{
+		{addr: "a", rtt: 10 * time.Millisecond},
+		{addr: "b", rtt: 5 * time.Millisecond},
+	}
+	election := newKeepaliveElection("a", results)
+
+	election.resign("b")
+
+	if !election.isActive("a") {
+		t.Error("a should still be active; only a non-active server resigned")
+	}
+}
+
+func TestKeepaliveElectionUpdateRTTAffectsPromotion(t *testing.T) {
+	results := []stunDiscoverResult{
+		{addr: "a", rtt: 10 * time.Millisecond},
+		{addr: "b", rtt: 5 * time.Millisecond},
+		{addr: "c", rtt: 20 * time.Millisecond},
+	}
+	election := newKeepaliveElection("a", results)
+
+	// c has since become the fastest-responding survivor.
+	election.updateRTT("c", time.Millisecond)
+
+	election.resign("a")
+
+	if !election.isActive("c") {
+		t.Error("expected c, now the fastest survivor, to be promoted")
+	}
+}
+
+func TestKeepaliveElectionNoSurvivorsLeavesNoneActive(t *testing.T) {
+	results := []stunDiscoverResult{
+		{addr: "a", rtt: 10 * time.Millisecond},
+	}
+	election := newKeepaliveElection("a", results)
+
+	election.resign("a")
+
+	if election.active != "" {
+		t.Errorf("active = %q, want none once the only server has resigned", election.active)
+	}
+}
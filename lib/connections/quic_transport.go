@@ -0,0 +1,145 @@
+// Copyright (C) 2019 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package connections
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AudriusButkevicius/pfilter"
+	"github.com/lucas-clemente/quic-go"
+
+	"github.com/syncthing/syncthing/lib/connections/registry"
+)
+
+// A quicTransport owns a single, filtered UDP socket that is shared between
+// the QUIC listener, the QUIC dialer and the STUN client for a given
+// scheme/address. Sharing the socket means the external mapping that STUN
+// discovers for our listener is also valid for sessions we dial out, which
+// is required for hole punching to work against restricted-cone NATs.
+type quicTransport struct {
+	uri        *url.URL
+	packetConn net.PacketConn
+	filterConn *pfilter.PacketFilter
+	quicConn   net.PacketConn
+	stunConn   net.PacketConn
+	listener   quic.Listener
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newQUICTransport binds the UDP socket for uri, wires up the STUN and QUIC
+// packet filters, and starts a quic.Listener on top of it.
+func newQUICTransport(uri *url.URL, tlsCfg *tls.Config) (*quicTransport, error) {
+	network := strings.Replace(uri.Scheme, "quic", "udp", -1)
+
+	packetConn, err := net.ListenPacket(network, uri.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	filterConn := pfilter.NewPacketFilter(packetConn)
+	quicConn := filterConn.NewConn(quicFilterPriority, nil)
+	stunConn := filterConn.NewConn(stunFilterPriority, &stunFilter{
+		ids: make(map[string]time.Time),
+	})
+	filterConn.Start()
+
+	registry.Register(uri.Scheme, quicConn)
+
+	listener, err := quic.Listen(quicConn, tlsCfg, quicConfig)
+	if err != nil {
+		registry.Unregister(uri.Scheme, quicConn)
+		stunConn.Close()
+		quicConn.Close()
+		filterConn.Close()
+		packetConn.Close()
+		return nil, err
+	}
+
+	return &quicTransport{
+		uri:        uri,
+		packetConn: packetConn,
+		filterConn: filterConn,
+		quicConn:   quicConn,
+		stunConn:   stunConn,
+		listener:   listener,
+	}, nil
+}
+
+// AcceptSession blocks until an incoming session is accepted on the shared
+// socket, or the listener is closed.
+func (t *quicTransport) AcceptSession() (quic.Session, error) {
+	return t.listener.Accept()
+}
+
+// DialSession dials raddr from the same shared socket the listener and STUN
+// client use, so the NAT mapping learned via STUN applies to this session
+// too. host is the remote peer's host/SNI, not our own listen address.
+func (t *quicTransport) DialSession(ctx context.Context, raddr net.Addr, host string, tlsCfg *tls.Config) (quic.Session, error) {
+	return quic.DialContext(ctx, t.quicConn, raddr, host, tlsCfg, quicConfig)
+}
+
+// STUNConn returns the packet conn STUN discovery and keepalives should use.
+func (t *quicTransport) STUNConn() net.PacketConn {
+	return t.stunConn
+}
+
+// LocalAddr returns the address of the shared socket.
+func (t *quicTransport) LocalAddr() net.Addr {
+	return t.quicConn.LocalAddr()
+}
+
+// Close tears down the listener and the shared socket. Serve's own defer
+// and its stop-watching goroutine can both reach this on a normal Stop(),
+// so it's guarded to run exactly once - unlike the one quic.Listener,
+// double-closing stunConn/quicConn/the registry entry/filterConn isn't
+// established as safe anywhere in this tree.
+func (t *quicTransport) Close() error {
+	t.closeOnce.Do(func() {
+		_ = t.listener.Close()
+		t.stunConn.Close()
+		t.quicConn.Close()
+		registry.Unregister(t.uri.Scheme, t.quicConn)
+		t.filterConn.Close()
+		t.closeErr = t.packetConn.Close()
+	})
+	return t.closeErr
+}
+
+// quicTransports tracks the live shared transport for each configured QUIC
+// listen address, keyed by scheme (quic, quic4, quic6), so that quicDialer
+// can reuse the listener's socket instead of opening its own.
+var (
+	quicTransportsMut sync.Mutex
+	quicTransports    = make(map[string]*quicTransport)
+)
+
+func registerQUICTransport(scheme string, t *quicTransport) {
+	quicTransportsMut.Lock()
+	quicTransports[scheme] = t
+	quicTransportsMut.Unlock()
+}
+
+func unregisterQUICTransport(scheme string) {
+	quicTransportsMut.Lock()
+	delete(quicTransports, scheme)
+	quicTransportsMut.Unlock()
+}
+
+func getQUICTransport(scheme string) (*quicTransport, bool) {
+	quicTransportsMut.Lock()
+	t, ok := quicTransports[scheme]
+	quicTransportsMut.Unlock()
+	return t, ok
+}
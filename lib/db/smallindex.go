@@ -11,9 +11,26 @@ import (
 	"sort"
 
 	"github.com/syncthing/syncthing/lib/sync"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// metaNextID is a reserved id under the index's own prefix, used to persist
+// nextID so that load doesn't have to scan every tombstone between here and
+// the next Compact just to recompute it.
+const metaNextID = ^uint32(0)
+
+// readWriter is satisfied by anything that can iterate over, mutate and
+// batch-write the database. Compact needs all three: it walks the prefix
+// to find tombstones, then drops and renumbers what it finds in a single
+// atomic batch.
+type readWriter interface {
+	reader
+	writer
+	Write(*leveldb.Batch, *opt.WriteOptions) error
+}
+
 // A smallIndex is an in memory bidirectional []byte to uint32 map. It gives
 // fast lookups in both directions and persists to the database. Don't use for
 // storing more items than fit comfortably in RAM.
@@ -36,14 +53,31 @@ func newSmallIndex(r reader, prefix []byte) *smallIndex {
 	return idx
 }
 
+// key builds the database key for id under the index's prefix.
+func (i *smallIndex) key(id uint32) []byte {
+	key := make([]byte, len(i.prefix)+8) // prefix plus uint32 id
+	copy(key, i.prefix)
+	binary.BigEndian.PutUint32(key[len(i.prefix):], id)
+	return key
+}
+
 // load iterates over the prefix space in the database and populates the in
-// memory maps.
+// memory maps. If a previous Compact left a meta/nextID sentinel behind, it
+// seeds nextID from that instead of having to infer it from the highest id
+// seen while iterating.
 func (i *smallIndex) load(r reader) {
+	if val, err := r.Get(i.key(metaNextID), nil); err == nil && len(val) == 4 {
+		i.nextID = binary.BigEndian.Uint32(val)
+	}
+
 	it := r.NewIterator(util.BytesPrefix(i.prefix), nil)
 	defer it.Release()
 	for it.Next() {
-		val := string(it.Value())
 		id := binary.BigEndian.Uint32(it.Key()[len(i.prefix):])
+		if id == metaNextID {
+			continue
+		}
+		val := string(it.Value())
 		if val != "" {
 			// Empty value means the entry has been deleted.
 			i.id2val[id] = val
@@ -76,10 +110,7 @@ func (i *smallIndex) ID(w writer, val []byte) uint32 {
 	i.val2id[valStr] = id
 	i.id2val[id] = valStr
 
-	key := make([]byte, len(i.prefix)+8) // prefix plus uint32 id
-	copy(key, i.prefix)
-	binary.BigEndian.PutUint32(key[len(i.prefix):], id)
-	if err := w.Put(key, val, nil); err != nil {
+	if err := w.Put(i.key(id), val, nil); err != nil {
 		panic(err)
 	}
 
@@ -118,15 +149,10 @@ func (i *smallIndex) Delete(w writer, val []byte) {
 
 	// Check the reverse mapping to get the ID for the value.
 	if id, ok := i.val2id[string(val)]; ok {
-		// Generate the corresponding database key.
-		key := make([]byte, len(i.prefix)+8) // prefix plus uint32 id
-		copy(key, i.prefix)
-		binary.BigEndian.PutUint32(key[len(i.prefix):], id)
-
 		// Put an empty value into the database. This indicates that the
 		// entry does not exist any more and prevents the ID from being
-		// reused in the future.
-		if err := w.Put(key, []byte{}, nil); err != nil {
+		// reused in the future, until a Compact comes along and reclaims it.
+		if err := w.Put(i.key(id), []byte{}, nil); err != nil {
 			panic(err)
 		}
 
@@ -155,3 +181,104 @@ func (i *smallIndex) Values() []string {
 	sort.Strings(vals)
 	return vals
 }
+
+// Iterate calls fn for every live (id, val) pair in the index, stopping
+// early if fn returns false. Unlike Values, it doesn't materialise the
+// whole set first, which matters once the index is large. fn must not call
+// back into the index (ID, IDRO, Val, Delete, Compact, Iterate), as i.mut
+// is held for the duration of the call.
+func (i *smallIndex) Iterate(fn func(id uint32, val []byte) bool) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+
+	for id, val := range i.id2val {
+		if !fn(id, []byte(val)) {
+			return
+		}
+	}
+}
+
+// A Rewriter is called by Compact for every surviving (oldID, newID, val)
+// triple right before the entry is renumbered, so that higher layers that
+// embedded the old id in their own keys can move those keys across too. It
+// must not call back into the same smallIndex (ID, IDRO, Val, Delete,
+// Compact, Iterate), as i.mut is held for the duration of the call.
+type Rewriter func(oldID, newID uint32, val []byte)
+
+// Compact drops tombstones left behind by Delete from the database, and
+// renumbers the surviving entries into a dense [0, len) id range, calling
+// rewrite for each one that moves so the caller can update any keys of its
+// own that embedded the old id. The tombstone drops, the renumbering
+// put/delete pairs and the meta/nextID sentinel are all written as a single
+// batch, so a crash mid-Compact can never leave both an old and a new key
+// for the same value on disk. It holds the index's lock for as long as the
+// compaction takes, so every other smallIndex method (including reads like
+// Val and IDRO) blocks until it returns; run it off the hot path.
+//
+// Nothing calls Compact yet. It's meant to be driven periodically, off the
+// hot path, by a maintenance goroutine in the db package that also knows
+// which Rewriter to pass for each smallIndex it owns (e.g. folder and
+// device indexes embed these ids in their own keys); that goroutine isn't
+// part of this checkout.
+func (i *smallIndex) Compact(db readWriter, rewrite Rewriter) error {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+
+	batch := new(leveldb.Batch)
+
+	it := db.NewIterator(util.BytesPrefix(i.prefix), nil)
+	for it.Next() {
+		id := binary.BigEndian.Uint32(it.Key()[len(i.prefix):])
+		if id == metaNextID || len(it.Value()) > 0 {
+			continue
+		}
+		// A tombstone; now's our chance to actually get rid of it.
+		batch.Delete(append([]byte(nil), it.Key()...))
+	}
+	if err := it.Error(); err != nil {
+		it.Release()
+		return err
+	}
+	it.Release()
+
+	// Snapshot the live ids in a stable order, so renumbering doesn't depend
+	// on map iteration order.
+	ids := make([]uint32, 0, len(i.id2val))
+	for id := range i.id2val {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+
+	id2val := make(map[uint32]string, len(ids))
+	val2id := make(map[string]uint32, len(ids))
+
+	for newID64, oldID := range ids {
+		newID := uint32(newID64)
+		val := i.id2val[oldID]
+
+		if newID != oldID {
+			batch.Put(i.key(newID), []byte(val))
+			batch.Delete(i.key(oldID))
+			if rewrite != nil {
+				rewrite(oldID, newID, []byte(val))
+			}
+		}
+
+		id2val[newID] = val
+		val2id[val] = newID
+	}
+
+	nextID := uint32(len(ids))
+	var nextIDBytes [4]byte
+	binary.BigEndian.PutUint32(nextIDBytes[:], nextID)
+	batch.Put(i.key(metaNextID), nextIDBytes[:])
+
+	if err := db.Write(batch, nil); err != nil {
+		return err
+	}
+
+	i.id2val = id2val
+	i.val2id = val2id
+	i.nextID = nextID
+	return nil
+}
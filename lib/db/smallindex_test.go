@@ -0,0 +1,123 @@
+// Copyright (C) 2018 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+var smallIndexTestPrefix = []byte{42}
+
+func newTestDB(t *testing.T) *leveldb.DB {
+	t.Helper()
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSmallIndexCompactReclaimsTombstones(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	idx := newSmallIndex(db, smallIndexTestPrefix)
+
+	idA := idx.ID(db, []byte("a"))
+	idx.ID(db, []byte("b"))
+	idx.ID(db, []byte("c"))
+	idx.Delete(db, []byte("a"))
+
+	if err := idx.Compact(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tombstone for "a" should be gone from the database entirely, not
+	// just absent from the in-memory maps.
+	if val, err := db.Get(idx.key(idA), nil); err == nil {
+		t.Errorf("expected tombstone for id %d to be reclaimed, found value %q", idA, val)
+	} else if err != leveldb.ErrNotFound {
+		t.Errorf("unexpected error reading reclaimed key: %v", err)
+	}
+
+	if _, ok := idx.IDRO([]byte("a")); ok {
+		t.Error("deleted value still resolves to an id after Compact")
+	}
+	if got := idx.Values(); len(got) != 2 {
+		t.Errorf("Values() = %v, want two surviving entries", got)
+	}
+}
+
+func TestSmallIndexCompactRenumbersAndRewrites(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	idx := newSmallIndex(db, smallIndexTestPrefix)
+
+	idx.ID(db, []byte("a"))
+	idB := idx.ID(db, []byte("b"))
+	idC := idx.ID(db, []byte("c"))
+	idx.Delete(db, []byte("a"))
+
+	rewrites := make(map[uint32]uint32)
+	if err := idx.Compact(db, func(oldID, newID uint32, val []byte) {
+		rewrites[oldID] = newID
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// "a" was id 0 and got deleted, so "b" (was 1) and "c" (was 2) must have
+	// been renumbered down by one to keep the id space dense.
+	wantB, wantC := uint32(0), uint32(1)
+	if newB, ok := idx.IDRO([]byte("b")); !ok || newB != wantB {
+		t.Errorf("IDRO(b) = %d, %v, want %d, true", newB, ok, wantB)
+	}
+	if newC, ok := idx.IDRO([]byte("c")); !ok || newC != wantC {
+		t.Errorf("IDRO(c) = %d, %v, want %d, true", newC, ok, wantC)
+	}
+	if rewrites[idB] != wantB {
+		t.Errorf("rewrite callback for old id %d: got new id %d, want %d", idB, rewrites[idB], wantB)
+	}
+	if rewrites[idC] != wantC {
+		t.Errorf("rewrite callback for old id %d: got new id %d, want %d", idC, rewrites[idC], wantC)
+	}
+}
+
+func TestSmallIndexLoadAfterCompactUsesSentinel(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	idx := newSmallIndex(db, smallIndexTestPrefix)
+	idx.ID(db, []byte("a"))
+	idx.ID(db, []byte("b"))
+	idx.Delete(db, []byte("a"))
+
+	if err := idx.Compact(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	// After Compact, only "b" survives, renumbered to id 0, so nextID should
+	// be 1.
+	if idx.nextID != 1 {
+		t.Fatalf("idx.nextID = %d after Compact, want 1", idx.nextID)
+	}
+
+	// A fresh smallIndex loaded from the same database must pick up nextID
+	// from the meta/nextID sentinel rather than rescanning tombstones, and
+	// must agree with the compacted instance.
+	reloaded := newSmallIndex(db, smallIndexTestPrefix)
+	if reloaded.nextID != idx.nextID {
+		t.Errorf("reloaded nextID = %d, want %d", reloaded.nextID, idx.nextID)
+	}
+
+	newID := reloaded.ID(db, []byte("d"))
+	if newID != 1 {
+		t.Errorf("first id allocated after reload = %d, want 1", newID)
+	}
+}